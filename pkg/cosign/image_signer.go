@@ -2,10 +2,12 @@ package cosign
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/buildpacks/lifecycle/platform"
 	"github.com/pkg/errors"
@@ -13,82 +15,178 @@ import (
 	"github.com/sigstore/cosign/cmd/cosign/cli/sign"
 )
 
+// SignFunc wraps cosign's sign.SignCmd, which itself only ever returns an error -
+// it doesn't surface the Rekor entry it may have uploaded to its caller.
 type SignFunc func(
 	ctx context.Context, ko sign.KeyOpts, registryOptions options.RegistryOptions, annotations map[string]interface{}, imageRef []string,
 	certPath string, upload bool, outputSignature, outputCertificate string,
-	payloadPath string, force, recursive bool, attachment string,
+	payloadPath string, force, recursive, tlogUpload bool, attachment string,
+) error
+
+// TlogEntryFunc looks up the Rekor transparency log entry cosign created for a
+// signature or attestation it just uploaded to refImage, wrapping cosign's
+// lower-level tlog/bundle API rather than SignCmd/AttestCmd, neither of which hand
+// the log index back to their caller. signatureDigest is the digest of the
+// signature (or attestation) payload recorded in that entry.
+type TlogEntryFunc func(ctx context.Context, rekorURL, refImage string) (logIndex, signatureDigest string, err error)
+
+// AttestFunc wraps cosign's attest.AttestCmd, producing and uploading an in-toto
+// attestation for imageRef whose payload is predicateType-shaped content read from
+// predicatePath.
+type AttestFunc func(
+	ctx context.Context, ko sign.KeyOpts, registryOptions options.RegistryOptions,
+	predicatePath, predicateType string, imageRef string, force, tlogUpload bool,
 ) error
 
 type ImageSigner struct {
-	Logger   *log.Logger
-	signFunc SignFunc
+	Logger        *log.Logger
+	signFunc      SignFunc
+	attestFunc    AttestFunc
+	tlogEntryFunc TlogEntryFunc
 }
 
 const (
 	cosignRepositoryEnv       = "COSIGN_REPOSITORY"
 	cosignDockerMediaTypesEnv = "COSIGN_DOCKER_MEDIA_TYPES"
+
+	slsaProvenancePredicateType = "slsaprovenance"
+
+	// CosignRecursiveAnnotation, when set to "true" on the service account annotations
+	// passed in to Sign, signs every child manifest of a multi-arch image index in
+	// addition to the index itself, mirroring cosign's own "-r" flag.
+	CosignRecursiveAnnotation = "kpack.io/cosign.recursive"
+
+	cosignKeyFileName       = "cosign.key"
+	cosignPasswordFileName  = "cosign.password"
+	cosignKMSFileName       = "cosign.kms"
+	cosignOIDCTokenFileName = "cosign.oidc-token"
 )
 
-func NewImageSigner(logger *log.Logger, signFunc SignFunc) *ImageSigner {
+// SignatureRecord is the outcome of signing one tag with one cosign secret, returned by
+// Sign so callers can surface it on the Build's status (e.g. BuildStatus.LatestSignatures).
+// SignatureDigest and RekorLogIndex are only populated when tlog upload is enabled for
+// the secret, since the Rekor bundle is the only place this thin cosign adapter can read
+// the signature digest back from.
+type SignatureRecord struct {
+	Tag             string
+	ImageDigest     string
+	SignatureDigest string
+	RekorLogIndex   string
+}
+
+// AttestationRecord is the outcome of attesting one predicate type with one cosign
+// secret, returned by Attest so callers can surface it on the Build's status.
+// SignatureDigest and RekorLogIndex are only populated when tlog upload is enabled for
+// the secret, for the same reason as SignatureRecord.
+type AttestationRecord struct {
+	Tag             string
+	PredicateType   string
+	ImageDigest     string
+	SignatureDigest string
+	RekorLogIndex   string
+}
+
+// cosignSigningStrategy is how a given cosign secret authenticates signing, determined
+// from which files are present in its secret directory.
+type cosignSigningStrategy int
+
+const (
+	// cosignStrategyKeyPair signs with a cosign.key/cosign.password file pair.
+	cosignStrategyKeyPair cosignSigningStrategy = iota
+	// cosignStrategyKMS signs with a key held by a KMS referenced by a cosign.kms file.
+	cosignStrategyKMS
+	// cosignStrategyKeyless signs keylessly against Fulcio using an OIDC token found in
+	// a cosign.oidc-token file.
+	cosignStrategyKeyless
+)
+
+// cosignSecret describes one secret directory found under a Build's secret mount and
+// which signing strategy it resolved to.
+type cosignSecret struct {
+	name     string
+	strategy cosignSigningStrategy
+	kmsRef   string
+}
+
+func NewImageSigner(logger *log.Logger, signFunc SignFunc, attestFunc AttestFunc, tlogEntryFunc TlogEntryFunc) *ImageSigner {
 	return &ImageSigner{
-		Logger:   logger,
-		signFunc: signFunc,
+		Logger:        logger,
+		signFunc:      signFunc,
+		attestFunc:    attestFunc,
+		tlogEntryFunc: tlogEntryFunc,
 	}
 }
 
-func (s *ImageSigner) Sign(ctx context.Context, report platform.ExportReport, secretLocation string, annotations, cosignRepositories, cosignDockerMediaTypes map[string]interface{}) error {
+func (s *ImageSigner) Sign(ctx context.Context, report platform.ExportReport, secretLocation string, annotations, cosignRepositories, cosignDockerMediaTypes, cosignRekorURLs map[string]interface{}) ([]SignatureRecord, error) {
 	cosignSecrets, err := findCosignSecrets(secretLocation)
 	if err != nil {
-		return errors.Errorf("no keys found for cosign signing: %v\n", err)
+		return nil, errors.Errorf("no keys found for cosign signing: %v\n", err)
 	}
 
 	if len(cosignSecrets) == 0 {
-		return errors.New("no keys found for cosign signing")
+		return nil, errors.New("no keys found for cosign signing")
 	}
 
 	if len(report.Image.Tags) == 0 {
-		return errors.New("no image found in report to sign")
+		return nil, errors.New("no image found in report to sign")
 	}
 
-	refImage := report.Image.Tags[0]
+	recursive := fmt.Sprintf("%v", annotations[CosignRecursiveAnnotation]) == "true"
 
-	for _, cosignSecret := range cosignSecrets {
-		if err := s.sign(ctx, refImage, secretLocation, cosignSecret, annotations, cosignRepositories, cosignDockerMediaTypes); err != nil {
-			return err
+	// CosignRecursiveAnnotation is kpack-internal control metadata, not something the
+	// user intended to embed in the published signature - strip it before forwarding
+	// the rest of the annotations on to signFunc.
+	signatureAnnotations := make(map[string]interface{}, len(annotations))
+	for k, v := range annotations {
+		if k == CosignRecursiveAnnotation {
+			continue
 		}
+		signatureAnnotations[k] = v
 	}
 
-	return nil
-}
+	var records []SignatureRecord
 
-func (s *ImageSigner) sign(ctx context.Context, refImage, secretLocation, cosignSecret string, annotations, cosignRepositories, cosignDockerMediaTypes map[string]interface{}) error {
-	cosignKeyFile := fmt.Sprintf("%s/%s/cosign.key", secretLocation, cosignSecret)
-	cosignPasswordFile := fmt.Sprintf("%s/%s/cosign.password", secretLocation, cosignSecret)
+	for _, refImage := range report.Image.Tags {
+		for _, cosignSecret := range cosignSecrets {
+			record, err := s.sign(ctx, refImage, report.Image.Digest, secretLocation, cosignSecret, recursive, signatureAnnotations, cosignRepositories, cosignDockerMediaTypes, cosignRekorURLs)
+			if err != nil {
+				return records, errors.Wrapf(err, "signing tag %s", refImage)
+			}
 
-	ko := sign.KeyOpts{KeyRef: cosignKeyFile, PassFunc: func(bool) ([]byte, error) {
-		content, err := ioutil.ReadFile(cosignPasswordFile)
-		// When password file is not available, default empty password is used
-		if err != nil {
-			return []byte(""), nil
+			records = append(records, record)
 		}
+	}
+
+	return records, nil
+}
+
+func (s *ImageSigner) sign(ctx context.Context, refImage, imageDigest, secretLocation string, cosignSecret cosignSecret, recursive bool, annotations, cosignRepositories, cosignDockerMediaTypes, cosignRekorURLs map[string]interface{}) (SignatureRecord, error) {
+	record := SignatureRecord{Tag: refImage, ImageDigest: imageDigest}
 
-		return content, nil
-	}}
+	ko, err := s.keyOpts(secretLocation, cosignSecret)
+	if err != nil {
+		return record, err
+	}
 
-	if cosignRepository, ok := cosignRepositories[cosignSecret]; ok {
+	if cosignRepository, ok := cosignRepositories[cosignSecret.name]; ok {
 		if err := os.Setenv(cosignRepositoryEnv, fmt.Sprintf("%s", cosignRepository)); err != nil {
-			return errors.Errorf("failed setting %s env variable: %v", cosignRepositoryEnv, err)
+			return record, errors.Errorf("failed setting %s env variable: %v", cosignRepositoryEnv, err)
 		}
 		defer os.Unsetenv(cosignRepositoryEnv)
 	}
 
-	if cosignDockerMediaType, ok := cosignDockerMediaTypes[cosignSecret]; ok {
+	if cosignDockerMediaType, ok := cosignDockerMediaTypes[cosignSecret.name]; ok {
 		if err := os.Setenv(cosignDockerMediaTypesEnv, fmt.Sprintf("%s", cosignDockerMediaType)); err != nil {
-			return errors.Errorf("failed setting COSIGN_DOCKER_MEDIA_TYPES env variable: %v", err)
+			return record, errors.Errorf("failed setting COSIGN_DOCKER_MEDIA_TYPES env variable: %v", err)
 		}
 		defer os.Unsetenv(cosignDockerMediaTypesEnv)
 	}
 
+	rekorURL, tlogUpload := cosignRekorURLs[cosignSecret.name]
+	if tlogUpload {
+		ko.RekorURL = fmt.Sprintf("%s", rekorURL)
+	}
+
 	if err := s.signFunc(
 		ctx,
 		ko,
@@ -101,16 +199,226 @@ func (s *ImageSigner) sign(ctx context.Context, refImage, secretLocation, cosign
 		"",
 		"",
 		false,
-		false,
+		recursive,
+		tlogUpload,
 		""); err != nil {
-		return errors.Errorf("unable to sign image with %s: %v", cosignKeyFile, err)
+		return record, errors.Errorf("unable to sign image with secret %s: %v", cosignSecret.name, err)
+	}
+
+	if !tlogUpload {
+		return record, nil
+	}
+
+	logIndex, signatureDigest, err := s.tlogEntryFunc(ctx, ko.RekorURL, refImage)
+	if err != nil {
+		return record, errors.Errorf("unable to look up rekor log entry for %s with secret %s: %v", refImage, cosignSecret.name, err)
+	}
+
+	record.RekorLogIndex = logIndex
+	record.SignatureDigest = signatureDigest
+
+	return record, nil
+}
+
+// keyOpts builds the sign.KeyOpts for cosignSecret according to the signing strategy
+// findCosignSecrets resolved it to.
+func (s *ImageSigner) keyOpts(secretLocation string, secret cosignSecret) (sign.KeyOpts, error) {
+	switch secret.strategy {
+	case cosignStrategyKMS:
+		return sign.KeyOpts{KeyRef: secret.kmsRef}, nil
+	case cosignStrategyKeyless:
+		token, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/%s", secretLocation, secret.name, cosignOIDCTokenFileName))
+		if err != nil {
+			return sign.KeyOpts{}, errors.Wrapf(err, "reading OIDC token for secret %s", secret.name)
+		}
+
+		return sign.KeyOpts{
+			FulcioURL:  options.DefaultFulcioURL,
+			OIDCIssuer: options.DefaultOIDCIssuerURL,
+			IDToken:    strings.TrimSpace(string(token)),
+		}, nil
+	default:
+		cosignKeyFile := fmt.Sprintf("%s/%s/%s", secretLocation, secret.name, cosignKeyFileName)
+		cosignPasswordFile := fmt.Sprintf("%s/%s/%s", secretLocation, secret.name, cosignPasswordFileName)
+
+		return sign.KeyOpts{KeyRef: cosignKeyFile, PassFunc: func(bool) ([]byte, error) {
+			content, err := ioutil.ReadFile(cosignPasswordFile)
+			// When password file is not available, default empty password is used
+			if err != nil {
+				return []byte(""), nil
+			}
+
+			return content, nil
+		}}, nil
+	}
+}
+
+// Attest generates an in-toto attestation for each of predicateTypes and signs it with
+// every cosign secret found at secretLocation, reusing the same secret-discovery,
+// COSIGN_REPOSITORY and Rekor handling as Sign.
+func (s *ImageSigner) Attest(ctx context.Context, report platform.ExportReport, secretLocation string, predicateTypes []string, builderImage string, buildpacks []string, gitRevision, gitCommit string, cosignRepositories, cosignRekorURLs map[string]interface{}) ([]AttestationRecord, error) {
+	cosignSecrets, err := findCosignSecrets(secretLocation)
+	if err != nil {
+		return nil, errors.Errorf("no keys found for cosign signing: %v\n", err)
+	}
+
+	if len(cosignSecrets) == 0 {
+		return nil, errors.New("no keys found for cosign signing")
+	}
+
+	if len(report.Image.Tags) == 0 {
+		return nil, errors.New("no image found in report to attest")
+	}
+
+	var records []AttestationRecord
+
+	for _, predicateType := range predicateTypes {
+		predicatePath, err := s.writePredicate(report, predicateType, builderImage, buildpacks, gitRevision, gitCommit)
+		if err != nil {
+			return records, err
+		}
+		defer os.Remove(predicatePath)
+
+		for _, refImage := range report.Image.Tags {
+			for _, cosignSecret := range cosignSecrets {
+				record, err := s.attest(ctx, refImage, report.Image.Digest, secretLocation, cosignSecret, predicatePath, predicateType, cosignRepositories, cosignRekorURLs)
+				if err != nil {
+					return records, errors.Wrapf(err, "attesting tag %s", refImage)
+				}
+
+				records = append(records, record)
+			}
+		}
+	}
+
+	return records, nil
+}
+
+func (s *ImageSigner) attest(ctx context.Context, refImage, imageDigest, secretLocation string, cosignSecret cosignSecret, predicatePath, predicateType string, cosignRepositories, cosignRekorURLs map[string]interface{}) (AttestationRecord, error) {
+	record := AttestationRecord{Tag: refImage, PredicateType: predicateType, ImageDigest: imageDigest}
+
+	ko, err := s.keyOpts(secretLocation, cosignSecret)
+	if err != nil {
+		return record, err
+	}
+
+	if cosignRepository, ok := cosignRepositories[cosignSecret.name]; ok {
+		if err := os.Setenv(cosignRepositoryEnv, fmt.Sprintf("%s", cosignRepository)); err != nil {
+			return record, errors.Errorf("failed setting %s env variable: %v", cosignRepositoryEnv, err)
+		}
+		defer os.Unsetenv(cosignRepositoryEnv)
 	}
 
-	return nil
+	rekorURL, tlogUpload := cosignRekorURLs[cosignSecret.name]
+	if tlogUpload {
+		ko.RekorURL = fmt.Sprintf("%s", rekorURL)
+	}
+
+	if err := s.attestFunc(
+		ctx,
+		ko,
+		options.RegistryOptions{KubernetesKeychain: true},
+		predicatePath,
+		predicateType,
+		refImage,
+		// force=false mirrors sign()'s behavior: don't overwrite a pre-existing
+		// attestation for the same subject/predicate.
+		false,
+		tlogUpload); err != nil {
+		return record, errors.Errorf("unable to attest image with secret %s: %v", cosignSecret.name, err)
+	}
+
+	if !tlogUpload {
+		return record, nil
+	}
+
+	logIndex, signatureDigest, err := s.tlogEntryFunc(ctx, ko.RekorURL, refImage)
+	if err != nil {
+		return record, errors.Errorf("unable to look up rekor log entry for attestation on %s with secret %s: %v", refImage, cosignSecret.name, err)
+	}
+
+	record.RekorLogIndex = logIndex
+	record.SignatureDigest = signatureDigest
+
+	return record, nil
 }
 
-func findCosignSecrets(secretLocation string) ([]string, error) {
-	var result []string
+// writePredicate builds the predicate payload for predicateType from the available build
+// metadata and writes it to a temp file, returning its path for AttestFunc to read.
+func (s *ImageSigner) writePredicate(report platform.ExportReport, predicateType, builderImage string, buildpacks []string, gitRevision, gitCommit string) (string, error) {
+	var predicate interface{}
+
+	switch predicateType {
+	case slsaProvenancePredicateType:
+		predicate = slsaProvenance{
+			Builder:   slsaBuilder{ID: builderImage},
+			BuildType: "https://kpack.io/buildpacks-build",
+			Invocation: slsaInvocation{
+				ConfigSource: slsaConfigSource{
+					URI:    gitRevision,
+					Digest: map[string]string{"sha1": gitCommit},
+				},
+				Parameters: buildpacks,
+			},
+			Materials: []slsaMaterial{{URI: gitRevision, Digest: map[string]string{"sha1": gitCommit}}},
+		}
+	default:
+		return "", errors.Errorf("unsupported predicate type: %s", predicateType)
+	}
+
+	content, err := json.Marshal(predicate)
+	if err != nil {
+		return "", errors.Wrap(err, "marshalling predicate")
+	}
+
+	f, err := ioutil.TempFile("", "kpack-predicate-*.json")
+	if err != nil {
+		return "", errors.Wrap(err, "creating predicate file")
+	}
+	defer f.Close()
+
+	if _, err := f.Write(content); err != nil {
+		return "", errors.Wrap(err, "writing predicate file")
+	}
+
+	return f.Name(), nil
+}
+
+// slsaProvenance is a minimal https://slsa.dev/provenance/v0.2 predicate populated from
+// data kpack already has at hand once a build completes.
+type slsaProvenance struct {
+	Builder    slsaBuilder    `json:"builder"`
+	BuildType  string         `json:"buildType"`
+	Invocation slsaInvocation `json:"invocation"`
+	Materials  []slsaMaterial `json:"materials"`
+}
+
+type slsaBuilder struct {
+	ID string `json:"id"`
+}
+
+type slsaInvocation struct {
+	ConfigSource slsaConfigSource `json:"configSource"`
+	Parameters   []string         `json:"parameters"`
+}
+
+type slsaConfigSource struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+// findCosignSecrets discovers the cosign secrets mounted at secretLocation and, for each
+// one, determines which signing strategy it resolves to from the files present in its
+// directory: a cosign.kms file selects KMS-backed signing, a cosign.oidc-token file
+// selects keyless signing against Fulcio, and otherwise it falls back to the classic
+// cosign.key/cosign.password pair.
+func findCosignSecrets(secretLocation string) ([]cosignSecret, error) {
+	var result []cosignSecret
 
 	files, err := ioutil.ReadDir(secretLocation)
 	if err != nil {
@@ -118,9 +426,20 @@ func findCosignSecrets(secretLocation string) ([]string, error) {
 	}
 
 	for _, path := range files {
-		if path.IsDir() {
-			result = append(result, path.Name())
+		if !path.IsDir() {
+			continue
 		}
+
+		secret := cosignSecret{name: path.Name(), strategy: cosignStrategyKeyPair}
+
+		if kmsRef, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/%s", secretLocation, secret.name, cosignKMSFileName)); err == nil {
+			secret.strategy = cosignStrategyKMS
+			secret.kmsRef = strings.TrimSpace(string(kmsRef))
+		} else if _, err := os.Stat(fmt.Sprintf("%s/%s/%s", secretLocation, secret.name, cosignOIDCTokenFileName)); err == nil {
+			secret.strategy = cosignStrategyKeyless
+		}
+
+		result = append(result, secret)
 	}
 
 	return result, nil
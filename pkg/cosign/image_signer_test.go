@@ -0,0 +1,237 @@
+package cosign
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildpacks/lifecycle/platform"
+	"github.com/pkg/errors"
+	"github.com/sigstore/cosign/cmd/cosign/cli/options"
+	"github.com/sigstore/cosign/cmd/cosign/cli/sign"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageSignerSignRecursive(t *testing.T) {
+	secretLocation := t.TempDir()
+	secretDir := filepath.Join(secretLocation, "my-secret")
+	require.NoError(t, os.MkdirAll(secretDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.key"), []byte("fake-key"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.password"), []byte("fake-password"), 0600))
+
+	// a single tag is enough to exercise recursive pass-through; Sign itself doesn't
+	// need to know whether the tag points at an index or a single-platform image,
+	// it just forwards the recursive flag to signFunc.
+	report := platform.ExportReport{
+		Image: platform.ImageReport{
+			Tags: []string{"registry.io/my-app:latest"},
+		},
+	}
+
+	var gotRecursive []bool
+	signFunc := func(
+		ctx context.Context, ko sign.KeyOpts, registryOptions options.RegistryOptions, annotations map[string]interface{}, imageRef []string,
+		certPath string, upload bool, outputSignature, outputCertificate string,
+		payloadPath string, force, recursive, tlogUpload bool, attachment string,
+	) error {
+		gotRecursive = append(gotRecursive, recursive)
+		return nil
+	}
+
+	signer := NewImageSigner(log.New(ioutil.Discard, "", 0), signFunc, nil, nil)
+
+	annotations := map[string]interface{}{CosignRecursiveAnnotation: "true"}
+	_, err := signer.Sign(context.Background(), report, secretLocation, annotations, nil, nil, nil)
+	require.NoError(t, err)
+
+	require.Len(t, gotRecursive, 1)
+	require.True(t, gotRecursive[0], "expected signFunc to be invoked with recursive=true")
+}
+
+func TestImageSignerSignNotRecursiveByDefault(t *testing.T) {
+	secretLocation := t.TempDir()
+	secretDir := filepath.Join(secretLocation, "my-secret")
+	require.NoError(t, os.MkdirAll(secretDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.key"), []byte("fake-key"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.password"), []byte("fake-password"), 0600))
+
+	report := platform.ExportReport{
+		Image: platform.ImageReport{
+			Tags: []string{"registry.io/my-app:latest"},
+		},
+	}
+
+	var gotRecursive []bool
+	signFunc := func(
+		ctx context.Context, ko sign.KeyOpts, registryOptions options.RegistryOptions, annotations map[string]interface{}, imageRef []string,
+		certPath string, upload bool, outputSignature, outputCertificate string,
+		payloadPath string, force, recursive, tlogUpload bool, attachment string,
+	) error {
+		gotRecursive = append(gotRecursive, recursive)
+		return nil
+	}
+
+	signer := NewImageSigner(log.New(ioutil.Discard, "", 0), signFunc, nil, nil)
+
+	_, err := signer.Sign(context.Background(), report, secretLocation, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	require.Len(t, gotRecursive, 1)
+	require.False(t, gotRecursive[0], "expected signFunc to be invoked with recursive=false without the annotation")
+}
+
+func TestImageSignerAttestAllTags(t *testing.T) {
+	secretLocation := t.TempDir()
+	secretDir := filepath.Join(secretLocation, "my-secret")
+	require.NoError(t, os.MkdirAll(secretDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.key"), []byte("fake-key"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.password"), []byte("fake-password"), 0600))
+
+	report := platform.ExportReport{
+		Image: platform.ImageReport{
+			Tags: []string{"registry.io/my-app:latest", "registry.io/my-app:v1.0.0"},
+		},
+	}
+
+	type attestCall struct {
+		imageRef string
+		force    bool
+	}
+	var gotCalls []attestCall
+	attestFunc := func(
+		ctx context.Context, ko sign.KeyOpts, registryOptions options.RegistryOptions,
+		predicatePath, predicateType string, imageRef string, force, tlogUpload bool,
+	) error {
+		gotCalls = append(gotCalls, attestCall{imageRef: imageRef, force: force})
+		return nil
+	}
+
+	signer := NewImageSigner(log.New(ioutil.Discard, "", 0), nil, attestFunc, nil)
+
+	records, err := signer.Attest(context.Background(), report, secretLocation, []string{slsaProvenancePredicateType}, "builder-image", nil, "git-revision", "git-commit", nil, nil)
+	require.NoError(t, err)
+
+	require.Len(t, gotCalls, 2, "expected attestFunc to be invoked once per tag")
+	require.Equal(t, "registry.io/my-app:latest", gotCalls[0].imageRef)
+	require.Equal(t, "registry.io/my-app:v1.0.0", gotCalls[1].imageRef)
+	require.False(t, gotCalls[0].force, "expected attestFunc to be invoked with force=false, matching sign()")
+	require.False(t, gotCalls[1].force, "expected attestFunc to be invoked with force=false, matching sign()")
+
+	require.Len(t, records, 2)
+	require.Equal(t, "registry.io/my-app:latest", records[0].Tag)
+	require.Equal(t, "registry.io/my-app:v1.0.0", records[1].Tag)
+}
+
+func TestImageSignerKeyOptsKMS(t *testing.T) {
+	secretLocation := t.TempDir()
+	secretDir := filepath.Join(secretLocation, "my-secret")
+	require.NoError(t, os.MkdirAll(secretDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.kms"), []byte("awskms://my-key-arn"), 0600))
+
+	signer := NewImageSigner(log.New(ioutil.Discard, "", 0), nil, nil, nil)
+
+	cosignSecrets, err := findCosignSecrets(secretLocation)
+	require.NoError(t, err)
+	require.Len(t, cosignSecrets, 1)
+	require.Equal(t, cosignStrategyKMS, cosignSecrets[0].strategy)
+
+	ko, err := signer.keyOpts(secretLocation, cosignSecrets[0])
+	require.NoError(t, err)
+	require.Equal(t, "awskms://my-key-arn", ko.KeyRef)
+}
+
+func TestImageSignerKeyOptsKeyless(t *testing.T) {
+	secretLocation := t.TempDir()
+	secretDir := filepath.Join(secretLocation, "my-secret")
+	require.NoError(t, os.MkdirAll(secretDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.oidc-token"), []byte("fake-oidc-token\n"), 0600))
+
+	signer := NewImageSigner(log.New(ioutil.Discard, "", 0), nil, nil, nil)
+
+	cosignSecrets, err := findCosignSecrets(secretLocation)
+	require.NoError(t, err)
+	require.Len(t, cosignSecrets, 1)
+	require.Equal(t, cosignStrategyKeyless, cosignSecrets[0].strategy)
+
+	ko, err := signer.keyOpts(secretLocation, cosignSecrets[0])
+	require.NoError(t, err)
+	require.Equal(t, options.DefaultFulcioURL, ko.FulcioURL)
+	require.Equal(t, options.DefaultOIDCIssuerURL, ko.OIDCIssuer)
+	require.Equal(t, "fake-oidc-token", ko.IDToken)
+}
+
+func TestImageSignerSignTlogEntry(t *testing.T) {
+	secretLocation := t.TempDir()
+	secretDir := filepath.Join(secretLocation, "my-secret")
+	require.NoError(t, os.MkdirAll(secretDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.key"), []byte("fake-key"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.password"), []byte("fake-password"), 0600))
+
+	report := platform.ExportReport{
+		Image: platform.ImageReport{
+			Digest: "sha256:deadbeef",
+			Tags:   []string{"registry.io/my-app:latest"},
+		},
+	}
+
+	signFunc := func(
+		ctx context.Context, ko sign.KeyOpts, registryOptions options.RegistryOptions, annotations map[string]interface{}, imageRef []string,
+		certPath string, upload bool, outputSignature, outputCertificate string,
+		payloadPath string, force, recursive, tlogUpload bool, attachment string,
+	) error {
+		return nil
+	}
+
+	tlogEntryFunc := func(ctx context.Context, rekorURL, refImage string) (string, string, error) {
+		require.Equal(t, "https://rekor.example.com", rekorURL)
+		require.Equal(t, "registry.io/my-app:latest", refImage)
+		return "12345", "sha256:signaturedigest", nil
+	}
+
+	signer := NewImageSigner(log.New(ioutil.Discard, "", 0), signFunc, nil, tlogEntryFunc)
+
+	cosignRekorURLs := map[string]interface{}{"my-secret": "https://rekor.example.com"}
+	records, err := signer.Sign(context.Background(), report, secretLocation, nil, nil, nil, cosignRekorURLs)
+	require.NoError(t, err)
+
+	require.Len(t, records, 1)
+	require.Equal(t, "sha256:deadbeef", records[0].ImageDigest)
+	require.Equal(t, "sha256:signaturedigest", records[0].SignatureDigest)
+	require.Equal(t, "12345", records[0].RekorLogIndex)
+}
+
+func TestImageSignerSignTlogEntryError(t *testing.T) {
+	secretLocation := t.TempDir()
+	secretDir := filepath.Join(secretLocation, "my-secret")
+	require.NoError(t, os.MkdirAll(secretDir, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.key"), []byte("fake-key"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(secretDir, "cosign.password"), []byte("fake-password"), 0600))
+
+	report := platform.ExportReport{
+		Image: platform.ImageReport{
+			Tags: []string{"registry.io/my-app:latest"},
+		},
+	}
+
+	signFunc := func(
+		ctx context.Context, ko sign.KeyOpts, registryOptions options.RegistryOptions, annotations map[string]interface{}, imageRef []string,
+		certPath string, upload bool, outputSignature, outputCertificate string,
+		payloadPath string, force, recursive, tlogUpload bool, attachment string,
+	) error {
+		return nil
+	}
+
+	tlogEntryFunc := func(ctx context.Context, rekorURL, refImage string) (string, string, error) {
+		return "", "", errors.New("rekor lookup failed")
+	}
+
+	signer := NewImageSigner(log.New(ioutil.Discard, "", 0), signFunc, nil, tlogEntryFunc)
+
+	cosignRekorURLs := map[string]interface{}{"my-secret": "https://rekor.example.com"}
+	_, err := signer.Sign(context.Background(), report, secretLocation, nil, nil, nil, cosignRekorURLs)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rekor lookup failed")
+}